@@ -0,0 +1,60 @@
+package enproxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// DefaultAuthRealm is the realm advertised in the Proxy-Authenticate header
+// when an Auth implementation doesn't specify its own.
+const DefaultAuthRealm = "enproxy"
+
+// Auth governs proxy authentication for incoming requests handled by Proxy.
+// When Proxy.Auth is set, every request must carry a valid
+// Proxy-Authorization header or it is rejected with 407 Proxy Authentication
+// Required before the request is dispatched to handleConnect,
+// dispatchHTTP2 or serveEncapsulated.
+//
+// Implementations may be backed by static credentials, a reloadable file or
+// an external command, hence the explicit Stop() to release any associated
+// resources (file watchers, subprocesses, etc).
+type Auth interface {
+	// Validate checks req's Proxy-Authorization header, returning the
+	// authenticated identity (e.g. the username) on success. identity is
+	// passed to OnBytesReceived/OnBytesSent alongside clientIp. On
+	// failure, err is non-nil and identity should be ignored.
+	Validate(req *http.Request) (identity string, err error)
+
+	// Challenge writes a 407 response to resp, including a
+	// Proxy-Authenticate header for this Auth's realm.
+	Challenge(resp http.ResponseWriter)
+
+	// Stop releases any resources held by this Auth.
+	Stop()
+}
+
+// proxyAuthorization extracts and base64-decodes the "Basic" credentials
+// from req's Proxy-Authorization header, returning the username and
+// password. It returns an error if the header is missing or malformed.
+func proxyAuthorization(req *http.Request) (user string, pass string, err error) {
+	header := req.Header.Get("Proxy-Authorization")
+	if header == "" {
+		return "", "", fmt.Errorf("No Proxy-Authorization header supplied")
+	}
+	const prefix = "Basic "
+	if !strings.HasPrefix(header, prefix) {
+		return "", "", fmt.Errorf("Unsupported Proxy-Authorization scheme: %s", header)
+	}
+	return decodeBasicAuth(header[len(prefix):])
+}
+
+// challenge writes a 407 Proxy Authentication Required response for the
+// given realm.
+func challenge(resp http.ResponseWriter, realm string) {
+	if realm == "" {
+		realm = DefaultAuthRealm
+	}
+	resp.Header().Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", realm))
+	resp.WriteHeader(http.StatusProxyAuthRequired)
+}
@@ -0,0 +1,71 @@
+package enproxy
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// decodeBasicAuth decodes the base64 portion of a "Basic" Proxy-Authorization
+// header value into a username and password.
+func decodeBasicAuth(encoded string) (user string, pass string, err error) {
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", "", fmt.Errorf("Unable to base64-decode credentials: %s", err)
+	}
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("Malformed credentials")
+	}
+	return parts[0], parts[1], nil
+}
+
+// BasicAuth is an Auth that checks requests against a fixed, in-memory set
+// of username/password credentials. It's the simplest Auth implementation,
+// suitable for a handful of statically provisioned users.
+type BasicAuth struct {
+	// Realm is advertised to clients in the Proxy-Authenticate header. If
+	// empty, DefaultAuthRealm is used.
+	Realm string
+
+	mutex       sync.RWMutex
+	credentials map[string]string
+}
+
+// NewBasicAuth creates a BasicAuth that accepts the given username/password
+// credentials.
+func NewBasicAuth(credentials map[string]string) *BasicAuth {
+	copied := make(map[string]string, len(credentials))
+	for user, pass := range credentials {
+		copied[user] = pass
+	}
+	return &BasicAuth{credentials: copied}
+}
+
+// Validate implements the Auth interface.
+func (a *BasicAuth) Validate(req *http.Request) (string, error) {
+	user, pass, err := proxyAuthorization(req)
+	if err != nil {
+		return "", err
+	}
+	a.mutex.RLock()
+	expected, found := a.credentials[user]
+	a.mutex.RUnlock()
+	if !found || subtle.ConstantTimeCompare([]byte(expected), []byte(pass)) != 1 {
+		return "", fmt.Errorf("Invalid credentials for user %s", user)
+	}
+	return user, nil
+}
+
+// Challenge implements the Auth interface.
+func (a *BasicAuth) Challenge(resp http.ResponseWriter) {
+	challenge(resp, a.Realm)
+}
+
+// Stop implements the Auth interface. BasicAuth holds no resources, so this
+// is a no-op.
+func (a *BasicAuth) Stop() {
+}
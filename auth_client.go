@@ -0,0 +1,21 @@
+package enproxy
+
+import (
+	"encoding/base64"
+	"net/http"
+)
+
+// setProxyAuthHeader stamps req with a Basic Proxy-Authorization header for
+// user/pass. It's a no-op if user is empty, so Config.ProxyUser/ProxyPass
+// can be left unset for proxies that don't require authentication.
+//
+// doRequest calls this on every outbound request it builds, so credentials
+// configured via Config.ProxyUser/Config.ProxyPass are attached consistently
+// whether the request is an initial connect or a redial.
+func setProxyAuthHeader(req *http.Request, user string, pass string) {
+	if user == "" {
+		return
+	}
+	encoded := base64.StdEncoding.EncodeToString([]byte(user + ":" + pass))
+	req.Header.Set("Proxy-Authorization", "Basic "+encoded)
+}
@@ -0,0 +1,63 @@
+package enproxy
+
+import (
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+)
+
+// ExternalAuth is an Auth that delegates credential checking to an external
+// command, e.g. a script backed by PAM, LDAP or some other identity store
+// not otherwise supported here. Command is invoked as:
+//
+//	Command user
+//
+// with pass written to its stdin followed by a newline, so that the
+// password never appears in argv (and therefore not in `ps` output or
+// /proc/<pid>/cmdline). Command is considered to have validated the
+// credentials if it exits with status 0.
+type ExternalAuth struct {
+	// Realm is advertised to clients in the Proxy-Authenticate header. If
+	// empty, DefaultAuthRealm is used.
+	Realm string
+
+	// Command is the path to the external checker.
+	Command string
+
+	// Args are extra arguments prepended before the username on every
+	// invocation of Command, for example to select a PAM service name.
+	Args []string
+}
+
+// NewExternalAuth creates an ExternalAuth that checks credentials by running
+// command (with the given extra args before user; pass goes to stdin).
+func NewExternalAuth(command string, args ...string) *ExternalAuth {
+	return &ExternalAuth{Command: command, Args: args}
+}
+
+// Validate implements the Auth interface.
+func (a *ExternalAuth) Validate(req *http.Request) (string, error) {
+	user, pass, err := proxyAuthorization(req)
+	if err != nil {
+		return "", err
+	}
+
+	args := append(append([]string{}, a.Args...), user)
+	cmd := exec.Command(a.Command, args...)
+	cmd.Stdin = strings.NewReader(pass + "\n")
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s rejected user %s: %s", a.Command, user, err)
+	}
+	return user, nil
+}
+
+// Challenge implements the Auth interface.
+func (a *ExternalAuth) Challenge(resp http.ResponseWriter) {
+	challenge(resp, a.Realm)
+}
+
+// Stop implements the Auth interface. ExternalAuth holds no long-lived
+// resources between invocations, so this is a no-op.
+func (a *ExternalAuth) Stop() {
+}
@@ -0,0 +1,79 @@
+package enproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/getlantern/testify/assert"
+)
+
+// writeCheckerScript writes a shell script that exits 0 iff its first
+// argument is "alice" and its stdin (up to the first newline) is "secret",
+// standing in for an external PAM/LDAP-backed credential checker.
+func writeCheckerScript(t *testing.T) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("ExternalAuth shells out to a script; this test assumes a POSIX shell")
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "check.sh")
+	script := "#!/bin/sh\nread -r pass\nif [ \"$1\" = \"alice\" ] && [ \"$pass\" = \"secret\" ]; then exit 0; fi\nexit 1\n"
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatalf("Unable to write checker script: %v", err)
+	}
+	return path
+}
+
+func TestExternalAuthValidateSuccess(t *testing.T) {
+	auth := NewExternalAuth(writeCheckerScript(t))
+
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	req.Header.Set("Proxy-Authorization", basicAuthHeader("alice", "secret"))
+
+	identity, err := auth.Validate(req)
+	if assert.NoError(t, err, "Valid credentials should be accepted") {
+		assert.Equal(t, "alice", identity, "Identity should be the authenticated username")
+	}
+}
+
+func TestExternalAuthValidateRejected(t *testing.T) {
+	auth := NewExternalAuth(writeCheckerScript(t))
+
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	req.Header.Set("Proxy-Authorization", basicAuthHeader("alice", "wrong"))
+
+	_, err := auth.Validate(req)
+	assert.Error(t, err, "Wrong password should be rejected by the external command")
+}
+
+func TestExternalAuthValidatePassesArgsBeforeUser(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("ExternalAuth shells out to a script; this test assumes a POSIX shell")
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "check.sh")
+	script := "#!/bin/sh\nread -r pass\nif [ \"$1\" = \"--service\" ] && [ \"$2\" = \"sshd\" ] && [ \"$3\" = \"alice\" ] && [ \"$pass\" = \"secret\" ]; then exit 0; fi\nexit 1\n"
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatalf("Unable to write checker script: %v", err)
+	}
+
+	auth := NewExternalAuth(path, "--service", "sshd")
+
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	req.Header.Set("Proxy-Authorization", basicAuthHeader("alice", "secret"))
+	_, err := auth.Validate(req)
+	assert.NoError(t, err, "Args should be prepended before the username on every invocation")
+}
+
+func TestExternalAuthChallenge(t *testing.T) {
+	auth := &ExternalAuth{Realm: "test-realm"}
+	recorder := httptest.NewRecorder()
+
+	auth.Challenge(recorder)
+
+	assert.Equal(t, http.StatusProxyAuthRequired, recorder.Code, "Challenge should respond with 407")
+	assert.Equal(t, `Basic realm="test-realm"`, recorder.Header().Get("Proxy-Authenticate"), "Challenge should advertise the configured realm")
+}
@@ -0,0 +1,238 @@
+package enproxy
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// HtpasswdAuth is an Auth backed by an Apache-style htpasswd file. It
+// supports the password hash formats commonly found in such files -
+// bcrypt ($2a$/$2b$/$2y$), SHA1 ({SHA}) and APR1 MD5 ($apr1$) - and reloads
+// the file from disk whenever its mtime changes, so credentials can be
+// rotated without restarting the proxy.
+type HtpasswdAuth struct {
+	// Realm is advertised to clients in the Proxy-Authenticate header. If
+	// empty, DefaultAuthRealm is used.
+	Realm string
+
+	path string
+
+	mutex   sync.RWMutex
+	entries map[string]string
+	modTime time.Time
+}
+
+// NewHtpasswdAuth creates an HtpasswdAuth that checks credentials against the
+// htpasswd file at path. The file is read immediately so that an unreadable
+// or malformed file is reported at construction time rather than on the
+// first request.
+func NewHtpasswdAuth(path string) (*HtpasswdAuth, error) {
+	a := &HtpasswdAuth{path: path}
+	if err := a.reloadIfNecessary(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Validate implements the Auth interface.
+func (a *HtpasswdAuth) Validate(req *http.Request) (string, error) {
+	user, pass, err := proxyAuthorization(req)
+	if err != nil {
+		return "", err
+	}
+
+	if err := a.reloadIfNecessary(); err != nil {
+		return "", fmt.Errorf("Unable to reload htpasswd file %s: %s", a.path, err)
+	}
+
+	a.mutex.RLock()
+	hash, found := a.entries[user]
+	a.mutex.RUnlock()
+	if !found {
+		return "", fmt.Errorf("Unknown user %s", user)
+	}
+	if err := comparePassword(hash, pass); err != nil {
+		return "", fmt.Errorf("Invalid credentials for user %s: %s", user, err)
+	}
+	return user, nil
+}
+
+// Challenge implements the Auth interface.
+func (a *HtpasswdAuth) Challenge(resp http.ResponseWriter) {
+	challenge(resp, a.Realm)
+}
+
+// Stop implements the Auth interface. HtpasswdAuth reloads lazily on
+// Validate rather than watching the file in the background, so there's
+// nothing to tear down.
+func (a *HtpasswdAuth) Stop() {
+}
+
+// reloadIfNecessary re-reads the htpasswd file if its mtime has changed
+// since the last read.
+func (a *HtpasswdAuth) reloadIfNecessary() error {
+	info, err := os.Stat(a.path)
+	if err != nil {
+		return err
+	}
+
+	a.mutex.RLock()
+	current := a.modTime
+	a.mutex.RUnlock()
+	if info.ModTime().Equal(current) {
+		return nil
+	}
+
+	file, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	entries := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		entries[parts[0]] = parts[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	a.mutex.Lock()
+	a.entries = entries
+	a.modTime = info.ModTime()
+	a.mutex.Unlock()
+	return nil
+}
+
+// comparePassword checks password against an htpasswd hash, dispatching on
+// the hash's prefix to the appropriate algorithm.
+func comparePassword(hash string, password string) error {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		encoded := base64.StdEncoding.EncodeToString(sum[:])
+		if subtle.ConstantTimeCompare([]byte(encoded), []byte(hash[len("{SHA}"):])) != 1 {
+			return fmt.Errorf("SHA digest mismatch")
+		}
+		return nil
+	case strings.HasPrefix(hash, "$apr1$"):
+		if subtle.ConstantTimeCompare([]byte(apr1Crypt(password, hash)), []byte(hash)) != 1 {
+			return fmt.Errorf("APR1 digest mismatch")
+		}
+		return nil
+	default:
+		// Plain-old crypt(3) DES hashes aren't supported - they're
+		// obsolete and Go has no standard library implementation.
+		return fmt.Errorf("Unsupported htpasswd hash format")
+	}
+}
+
+// apr1Crypt implements the APR1 variant of the MD5-crypt algorithm used by
+// Apache's htpasswd -m. existingHash supplies the salt (and the "$apr1$"
+// identifier) to use when hashing password.
+func apr1Crypt(password string, existingHash string) string {
+	parts := strings.Split(existingHash, "$")
+	// existingHash looks like "$apr1$salt$hash", which splits into
+	// ["", "apr1", "salt", "hash"].
+	if len(parts) < 3 {
+		return ""
+	}
+	salt := parts[2]
+
+	ctx := md5.New()
+	ctx.Write([]byte(password))
+	ctx.Write([]byte("$apr1$"))
+	ctx.Write([]byte(salt))
+
+	ctx1 := md5.New()
+	ctx1.Write([]byte(password))
+	ctx1.Write([]byte(salt))
+	ctx1.Write([]byte(password))
+	final := ctx1.Sum(nil)
+
+	for i := len(password); i > 0; i -= 16 {
+		if i > 16 {
+			ctx.Write(final)
+		} else {
+			ctx.Write(final[:i])
+		}
+	}
+
+	for i := len(password); i != 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write([]byte(password[:1]))
+		}
+	}
+
+	final = ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		ctx1 := md5.New()
+		if i&1 != 0 {
+			ctx1.Write([]byte(password))
+		} else {
+			ctx1.Write(final)
+		}
+		if i%3 != 0 {
+			ctx1.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			ctx1.Write([]byte(password))
+		}
+		if i&1 != 0 {
+			ctx1.Write(final)
+		} else {
+			ctx1.Write([]byte(password))
+		}
+		final = ctx1.Sum(nil)
+	}
+
+	return "$apr1$" + salt + "$" + apr1Base64(final)
+}
+
+// apr1Base64 is the non-standard base64 alphabet and byte ordering used by
+// APR1/crypt MD5, following the reference to64() groupings from Apache's
+// apr_md5.c.
+func apr1Base64(data []byte) string {
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+	emit := func(out *[]byte, v uint32, n int) {
+		for i := 0; i < n; i++ {
+			*out = append(*out, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+
+	out := make([]byte, 0, 22)
+	groups := [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}}
+	for _, g := range groups {
+		v := uint32(data[g[0]])<<16 | uint32(data[g[1]])<<8 | uint32(data[g[2]])
+		emit(&out, v, 4)
+	}
+	emit(&out, uint32(data[11]), 2)
+	return string(out)
+}
@@ -0,0 +1,66 @@
+package enproxy
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func basicAuthHeader(user string, pass string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+}
+
+func TestBasicAuthValidateSuccess(t *testing.T) {
+	auth := NewBasicAuth(map[string]string{"alice": "secret"})
+
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	req.Header.Set("Proxy-Authorization", basicAuthHeader("alice", "secret"))
+
+	identity, err := auth.Validate(req)
+	if assert.NoError(t, err, "Valid credentials should be accepted") {
+		assert.Equal(t, "alice", identity, "Identity should be the authenticated username")
+	}
+}
+
+func TestBasicAuthValidateWrongPassword(t *testing.T) {
+	auth := NewBasicAuth(map[string]string{"alice": "secret"})
+
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	req.Header.Set("Proxy-Authorization", basicAuthHeader("alice", "wrong"))
+
+	_, err := auth.Validate(req)
+	assert.Error(t, err, "Wrong password should be rejected")
+}
+
+func TestBasicAuthValidateMissingHeader(t *testing.T) {
+	auth := NewBasicAuth(map[string]string{"alice": "secret"})
+
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+
+	_, err := auth.Validate(req)
+	assert.Error(t, err, "Missing Proxy-Authorization should be rejected")
+}
+
+func TestBasicAuthChallenge(t *testing.T) {
+	auth := &BasicAuth{Realm: "test-realm"}
+	recorder := httptest.NewRecorder()
+
+	auth.Challenge(recorder)
+
+	assert.Equal(t, http.StatusProxyAuthRequired, recorder.Code, "Challenge should respond with 407")
+	assert.Equal(t, `Basic realm="test-realm"`, recorder.Header().Get("Proxy-Authenticate"), "Challenge should advertise the configured realm")
+}
+
+func TestSetProxyAuthHeader(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+
+	setProxyAuthHeader(req, "alice", "secret")
+	assert.Equal(t, basicAuthHeader("alice", "secret"), req.Header.Get("Proxy-Authorization"), "Header should encode the given credentials")
+
+	req2, _ := http.NewRequest("GET", "http://example.com", nil)
+	setProxyAuthHeader(req2, "", "")
+	assert.Empty(t, req2.Header.Get("Proxy-Authorization"), "Empty user should leave the header unset")
+}
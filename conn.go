@@ -0,0 +1,294 @@
+package enproxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// X_ENPROXY_PROXY_HOST is the header an enproxy Proxy sets on its
+	// response to the first outbound request, telling the client which
+	// actual destination host it ended up talking to.
+	X_ENPROXY_PROXY_HOST = "X-Enproxy-Proxy-Host"
+
+	// OP_WRITE identifies a request carrying data to be written to the
+	// destination.
+	OP_WRITE = "write"
+
+	// OP_READ identifies a request polling for data read from the
+	// destination.
+	OP_READ = "read"
+
+	xEnproxyOp = "X-Enproxy-Op"
+)
+
+// Config configures how a Conn reaches its destination through an enproxy
+// Proxy. Each field below that was added for a specific transport/auth
+// feature points at the function or type that actually implements it, so the wiring for
+// that feature isn't just this struct definition.
+type Config struct {
+	// DialProxy dials the enproxy Proxy that will in turn connect to the
+	// destination address originally passed to Dial. addr is that same
+	// destination address, fed back in so DialProxy can make
+	// per-destination decisions (see SOCKS5ProxyDialer,
+	// ProxyFromEnvironment, ProxyFromPACURL).
+	DialProxy func(addr string) (net.Conn, error)
+
+	// ProxyResolver, if set, takes priority over DialProxy, picking the
+	// upstream to dial for a given destination address (see
+	// DialProxyFromResolver).
+	ProxyResolver ProxyResolver
+
+	// ProxyUser and ProxyPass, if ProxyUser is non-empty, are stamped as
+	// a Basic Proxy-Authorization header on every outbound request (see
+	// setProxyAuthHeader), for talking to a Proxy with Auth configured.
+	ProxyUser string
+	ProxyPass string
+
+	// Transport, if set, carries the encapsulated stream over a single
+	// multiplexed connection (see HTTP2Transport) instead of issuing one
+	// POST per chunk.
+	Transport Transport
+
+	// BufferRequests, if true, buffers the entire body of each outbound
+	// request before sending it rather than streaming it.
+	BufferRequests bool
+
+	// IdleTimeout is how long a Conn can go without activity before its
+	// processRequests goroutine gives up and closes it.
+	IdleTimeout time.Duration
+}
+
+// request is a single outbound chunk of data awaiting encapsulation in a
+// request to the proxy.
+type request struct {
+	data []byte
+}
+
+// WriteTo writes this request's data directly to w. It's used by
+// processRequestsMultiplexed to write into a multiplexed Transport stream,
+// where a chunk doesn't need its own *http.Request wrapper.
+func (r *request) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(r.data)
+	return int64(n), err
+}
+
+// hostWithResponse carries the result of the first outbound request back
+// to Dial, which waits on Conn.initialResponseCh for it (both
+// processRequests and processRequestsMultiplexed send there), since that's
+// the only request/response pair that reports which proxyHost the Proxy
+// resolved.
+type hostWithResponse struct {
+	proxyHost string
+	resp      *http.Response
+	err       error
+}
+
+// Conn is a net.Conn that tunnels its reads and writes through an enproxy
+// Proxy, encapsulating the stream as a sequence of HTTP requests (or, with
+// Config.Transport set, as a single multiplexed stream).
+type Conn struct {
+	// Addr is the destination address this Conn was dialed for.
+	Addr string
+
+	// Config governs how this Conn reaches its Proxy.
+	Config *Config
+
+	proxyHost string
+
+	requestOutCh      chan *request
+	requestFinishedCh chan error
+	stopRequestCh     chan struct{}
+	initialResponseCh chan hostWithResponse
+
+	requestMutex   sync.RWMutex
+	doneRequesting bool
+
+	activityMutex sync.Mutex
+	lastActivity  time.Time
+
+	closeMutex sync.Mutex
+	closed     bool
+	closedCh   chan struct{}
+
+	readPipeR *io.PipeReader
+	readPipeW *io.PipeWriter
+}
+
+// Dial creates a net.Conn that tunnels to addr through the Proxy reachable
+// via config.DialProxy (or config.ProxyResolver/config.Transport).
+func Dial(addr string, config *Config) (net.Conn, error) {
+	c := &Conn{
+		Addr:              addr,
+		Config:            config,
+		requestOutCh:      make(chan *request),
+		requestFinishedCh: make(chan error),
+		stopRequestCh:     make(chan struct{}),
+		initialResponseCh: make(chan hostWithResponse, 1),
+		closedCh:          make(chan struct{}),
+	}
+	c.readPipeR, c.readPipeW = io.Pipe()
+	c.markActive()
+	go c.processRequests()
+
+	first := <-c.initialResponseCh
+	if first.err != nil {
+		return nil, first.err
+	}
+	c.proxyHost = first.proxyHost
+	return c, nil
+}
+
+// Close stops this Conn's processRequests goroutine and marks it closed.
+func (c *Conn) Close() error {
+	c.closeMutex.Lock()
+	defer c.closeMutex.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.closedCh)
+	close(c.stopRequestCh)
+	c.readPipeW.Close()
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr                { return nil }
+func (c *Conn) RemoteAddr() net.Addr               { return nil }
+func (c *Conn) SetDeadline(t time.Time) error      { return nil }
+func (c *Conn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *Conn) SetWriteDeadline(t time.Time) error { return nil }
+
+// Read returns data delivered by whichever read path is active for this
+// Conn: processRequests copies each encapsulated response's body into the
+// read pipe as it arrives, and processRequestsMultiplexed's
+// readFromMultiplexedStream does the same for a multiplexed Transport
+// stream.
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.readPipeR.Read(b)
+}
+
+// copyFromReader drains r into this Conn's read pipe, so that Read
+// surfaces bytes arriving on an encapsulated response body or a
+// multiplexed Transport stream.
+func (c *Conn) copyFromReader(r io.Reader) error {
+	_, err := io.Copy(c.readPipeW, r)
+	return err
+}
+
+// Write submits b for encapsulated delivery and blocks until
+// processRequests has either sent it or given up.
+func (c *Conn) Write(b []byte) (int, error) {
+	c.markActive()
+	if !c.submitRequest(&request{data: b}) {
+		return 0, io.ErrClosedPipe
+	}
+	if err := <-c.requestFinishedCh; err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// isClosed reports whether Close has been called on this Conn.
+func (c *Conn) isClosed() bool {
+	select {
+	case <-c.closedCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// markActive records activity for isIdle's idle-timeout bookkeeping.
+func (c *Conn) markActive() {
+	c.activityMutex.Lock()
+	c.lastActivity = time.Now()
+	c.activityMutex.Unlock()
+}
+
+// isIdle reports whether this Conn has seen no activity for at least
+// Config.IdleTimeout. An IdleTimeout of zero means idle shutdown is
+// disabled entirely, rather than (as time.Since(...) >= 0 would otherwise
+// make true) every check immediately counting as idle.
+func (c *Conn) isIdle() bool {
+	if c.Config.IdleTimeout <= 0 {
+		return false
+	}
+	c.activityMutex.Lock()
+	defer c.activityMutex.Unlock()
+	return time.Since(c.lastActivity) >= c.Config.IdleTimeout
+}
+
+// proxyAddr is the address processRequestsMultiplexed asks its Transport to
+// open a stream to - the same destination address used by DialProxy, since
+// it's up to DialProxy/the Transport to decide where that actually
+// connects.
+func (c *Conn) proxyAddr() string {
+	return c.Addr
+}
+
+// dialer returns the dial function to use for reaching the proxy,
+// preferring Config.ProxyResolver over Config.DialProxy when both are set.
+func (c *Conn) dialer() (func(addr string) (net.Conn, error), error) {
+	if c.Config.ProxyResolver != nil {
+		return DialProxyFromResolver("tcp", c.Config.ProxyResolver), nil
+	}
+	if c.Config.DialProxy != nil {
+		return c.Config.DialProxy, nil
+	}
+	return nil, fmt.Errorf("No DialProxy or ProxyResolver configured")
+}
+
+// dialProxy establishes a fresh connection to the proxy for this Conn's
+// Addr, using whichever of Config.DialProxy/Config.ProxyResolver is
+// configured.
+func (c *Conn) dialProxy() (net.Conn, *bufio.Reader, error) {
+	dial, err := c.dialer()
+	if err != nil {
+		return nil, nil, err
+	}
+	proxyConn, err := dial(c.Addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return proxyConn, bufio.NewReader(proxyConn), nil
+}
+
+// redialProxyIfNecessary reuses proxyConn if it's still set, or dials a
+// fresh one otherwise (e.g. after the proxy closed a prior connection).
+// Because dialProxy always goes back through Config.DialProxy/
+// ProxyResolver, a redial correctly flows back through whatever upstream
+// (SOCKS5, PAC, environment) the original dial used.
+func (c *Conn) redialProxyIfNecessary(proxyConn net.Conn, bufReader *bufio.Reader) (net.Conn, *bufio.Reader, error) {
+	if proxyConn != nil {
+		return proxyConn, bufReader, nil
+	}
+	return c.dialProxy()
+}
+
+// doRequest builds and issues a single outbound HTTP request encapsulating
+// req's data, stamping Config.ProxyUser/ProxyPass if set, and reads back
+// the proxy's response.
+func (c *Conn) doRequest(proxyConn net.Conn, bufReader *bufio.Reader, proxyHost string, op string, req *request) (*http.Response, error) {
+	host := proxyHost
+	if host == "" {
+		host = c.Addr
+	}
+	httpReq, err := http.NewRequest("POST", "http://"+host+"/", bytes.NewReader(req.data))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set(xEnproxyOp, op)
+	setProxyAuthHeader(httpReq, c.Config.ProxyUser, c.Config.ProxyPass)
+
+	if err := httpReq.Write(proxyConn); err != nil {
+		return nil, err
+	}
+	return http.ReadResponse(bufReader, httpReq)
+}
@@ -0,0 +1,78 @@
+package enproxy
+
+import (
+	"io"
+	"log"
+	"time"
+)
+
+// processRequestsMultiplexed is the Transport-backed counterpart to
+// processRequests: instead of POSTing each outbound chunk as its own
+// request, it opens a single duplex stream via c.Config.Transport and
+// shuttles writes and reads over it for the lifetime of the Conn. Because
+// the stream guarantees in-order delivery on its own, there's no redial
+// cost to amortize, so the idle-timeout loop below just needs to notice
+// when the Conn has gone quiet and let the stream close.
+func (c *Conn) processRequestsMultiplexed() {
+	defer c.cleanupAfterRequests(nil)
+
+	dial, err := c.dialer()
+	if err != nil {
+		log.Printf("Unable to open multiplexed stream to proxy: %s", err)
+		c.initialResponseCh <- hostWithResponse{"", nil, err}
+		return
+	}
+
+	stream, err := c.Config.Transport.OpenStream(c.proxyAddr(), dial, c.Config.ProxyUser, c.Config.ProxyPass)
+	if err != nil {
+		log.Printf("Unable to open multiplexed stream to proxy: %s", err)
+		c.initialResponseCh <- hostWithResponse{"", nil, err}
+		return
+	}
+	defer stream.Close()
+
+	c.initialResponseCh <- hostWithResponse{"", nil, nil}
+
+	go c.readFromMultiplexedStream(stream)
+
+	for {
+		if c.isClosed() {
+			return
+		}
+
+		// A zero IdleTimeout means idle shutdown is disabled; leaving
+		// idleTimeout nil makes that select case block forever instead of
+		// firing on every loop iteration the way time.After(0) would.
+		var idleTimeout <-chan time.Time
+		if c.Config.IdleTimeout > 0 {
+			idleTimeout = time.After(c.Config.IdleTimeout)
+		}
+
+		select {
+		case request := <-c.requestOutCh:
+			_, err := request.WriteTo(stream)
+			c.requestFinishedCh <- err
+			if err != nil {
+				log.Printf("Error writing to multiplexed stream: %s", err)
+				return
+			}
+		case <-c.stopRequestCh:
+			return
+		case <-idleTimeout:
+			if c.isIdle() {
+				return
+			}
+		}
+	}
+}
+
+// readFromMultiplexedStream mirrors the read side of processRequests, but
+// against the single duplex stream opened by processRequestsMultiplexed
+// rather than successive response bodies. It runs for the lifetime of the
+// stream, handing received bytes off via copyFromReader the same way
+// processRequests does.
+func (c *Conn) readFromMultiplexedStream(stream io.Reader) {
+	if err := c.copyFromReader(stream); err != nil && err != io.EOF {
+		log.Printf("Error reading from multiplexed stream: %s", err)
+	}
+}
@@ -13,7 +13,16 @@ import (
 // deliver requests to the enproxy server in order. In-order delivery is
 // required because we are encapsulating a stream of data inside the bodies of
 // successive requests.
+//
+// If c.Config.Transport is set, that property is instead guaranteed by a
+// single multiplexed stream (see processRequestsMultiplexed), and this
+// POST-per-chunk path is skipped entirely.
 func (c *Conn) processRequests() {
+	if c.Config.Transport != nil {
+		c.processRequestsMultiplexed()
+		return
+	}
+
 	var resp *http.Response
 
 	defer c.cleanupAfterRequests(resp)
@@ -21,7 +30,9 @@ func (c *Conn) processRequests() {
 	// Dial proxy
 	proxyConn, bufReader, err := c.dialProxy()
 	if err != nil {
-		log.Printf("Unable to dial proxy for POSTing request: %s", err)
+		err = fmt.Errorf("Dest: %s    Unable to dial proxy for POSTing request: %s", c.Addr, err)
+		log.Println(err.Error())
+		c.initialResponseCh <- hostWithResponse{"", nil, err}
 		return
 	}
 	defer func() {
@@ -33,17 +44,42 @@ func (c *Conn) processRequests() {
 	}()
 
 	var proxyHost string
-	first := true
 
 	mkerror := func(text string, err error) error {
 		return fmt.Errorf("Dest: %s    ProxyHost: %s    %s: %s", c.Addr, proxyHost, text, err)
 	}
 
+	// Dial blocks on c.initialResponseCh, which it can't do by waiting for
+	// an application Write() - the caller doesn't get to Write() until Dial
+	// returns. So perform an initial (empty) round trip up front, purely to
+	// learn proxyHost and unblock Dial.
+	resp, err = c.doRequest(proxyConn, bufReader, proxyHost, OP_WRITE, &request{})
+	if err != nil {
+		err = mkerror("Unable to issue initial request", err)
+		log.Println(err.Error())
+		c.initialResponseCh <- hostWithResponse{"", nil, err}
+		return
+	}
+	proxyHost = resp.Header.Get(X_ENPROXY_PROXY_HOST)
+	c.initialResponseCh <- hostWithResponse{proxyHost, resp, nil}
+	if err := c.copyFromReader(resp.Body); err != nil && err != io.EOF {
+		log.Printf("Error reading initial response from proxy: %s", err)
+	}
+	resp.Body.Close()
+
 	for {
 		if c.isClosed() {
 			return
 		}
 
+		// A zero IdleTimeout means idle shutdown is disabled; leaving
+		// idleTimeout nil makes that select case block forever instead of
+		// firing on every loop iteration the way time.After(0) would.
+		var idleTimeout <-chan time.Time
+		if c.Config.IdleTimeout > 0 {
+			idleTimeout = time.After(c.Config.IdleTimeout)
+		}
+
 		select {
 		case request := <-c.requestOutCh:
 			// Redial the proxy if necessary
@@ -51,9 +87,7 @@ func (c *Conn) processRequests() {
 			if err != nil {
 				err = mkerror("Unable to redial proxy", err)
 				log.Println(err.Error())
-				if first {
-					c.initialResponseCh <- hostWithResponse{"", nil, err}
-				}
+				c.requestFinishedCh <- err
 				return
 			}
 
@@ -63,27 +97,15 @@ func (c *Conn) processRequests() {
 			if err != nil {
 				err = mkerror("Unable to issue write request", err)
 				log.Println(err.Error())
-				if first {
-					c.initialResponseCh <- hostWithResponse{"", nil, err}
-				}
 				return
 			}
-
-			if first {
-				// On our first request, find out what host we're actually
-				// talking to and remember that for future requests.
-				proxyHost = resp.Header.Get(X_ENPROXY_PROXY_HOST)
-				// Also post it to initialResponseCh so that the processReads()
-				// routine knows which proxyHost to use and gets the initial
-				// response data
-				c.initialResponseCh <- hostWithResponse{proxyHost, resp, nil}
-				first = false
-			} else {
-				resp.Body.Close()
+			if err := c.copyFromReader(resp.Body); err != nil && err != io.EOF {
+				log.Printf("Error reading response from proxy: %s", err)
 			}
+			resp.Body.Close()
 		case <-c.stopRequestCh:
 			return
-		case <-time.After(c.Config.IdleTimeout):
+		case <-idleTimeout:
 			if c.isIdle() {
 				return
 			}
@@ -129,4 +151,4 @@ func (c *Conn) cleanupAfterRequests(resp *http.Response) {
 			return
 		}
 	}
-}
\ No newline at end of file
+}
@@ -262,13 +262,13 @@ func startProxy(t *testing.T) {
 
 	go func() {
 		proxy := &Proxy{
-			OnBytesReceived: func(clientIp string, destAddr string, req *http.Request, bytes int64) {
+			OnBytesReceived: func(clientIp string, identity string, destAddr string, req *http.Request, bytes int64) {
 				statMutex.Lock()
 				bytesReceived += bytes
 				destsReceived[destAddr] = true
 				statMutex.Unlock()
 			},
-			OnBytesSent: func(clientIp string, destAddr string, req *http.Request, bytes int64) {
+			OnBytesSent: func(clientIp string, identity string, destAddr string, req *http.Request, bytes int64) {
 				statMutex.Lock()
 				bytesSent += bytes
 				destsSent[destAddr] = true
@@ -313,7 +313,7 @@ func startHttpsServer(t *testing.T) {
 	}
 
 	// Generate self-signed certificate
-	cert, err = pk.TLSCertificateFor("tlsdialer", "localhost", time.Now().Add(1*time.Hour), true, nil)
+	cert, err = pk.TLSCertificateFor(time.Now().Add(1*time.Hour), true, nil, "tlsdialer", "localhost")
 	if err != nil {
 		t.Fatalf("Unable to generate cert: %s", err)
 	}
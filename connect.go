@@ -0,0 +1,126 @@
+package enproxy
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// handleConnect services a standard HTTP CONNECT request by dialing
+// req.Host and then hijacking the client connection to shuttle raw bytes
+// between the two, bypassing the enproxy request-encapsulation path
+// entirely. Proxy.Serve dispatches here whenever the first request line of
+// a connection is "CONNECT ...", so a single listener transparently
+// supports both enproxy-encapsulated clients and plain CONNECT clients
+// (e.g. an ordinary HTTP client configured to use this proxy for HTTPS).
+//
+// If p.AlwaysMitm is set, or p.HandleConnect returns true for this request,
+// the connection is handed to mitmConnect instead of being relayed verbatim.
+//
+// This introduces several new Proxy fields: DialDest lets CONNECT targets
+// be reached through the same upstream used for encapsulated traffic (e.g.
+// via SOCKS5Dialer); HandleConnect/AlwaysMitm decide which CONNECT requests
+// to intercept, following goproxy's convention; MITMCAKey/MITMCACert are
+// the CA used by mintLeafCert to sign on-the-fly leaf certificates; and
+// OnRequest/OnResponse, only invoked for MITM'd connections, let callers
+// inspect or rewrite the now-plaintext request/response.
+func (p *Proxy) handleConnect(resp http.ResponseWriter, req *http.Request, clientIP string) {
+	if p.AlwaysMitm || p.HandleConnect != nil && p.HandleConnect(req) {
+		p.mitmConnect(resp, req, clientIP)
+		return
+	}
+
+	destHost := hostOnly(req.Host)
+	if err := p.checkDestinationAllowed(clientIP, destHost); err != nil {
+		http.Error(resp, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	upstream, err := p.dialDest(req.Host)
+	if err != nil {
+		http.Error(resp, "Unable to reach "+req.Host, http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+
+	hijacker, ok := resp.(http.Hijacker)
+	if !ok {
+		http.Error(resp, "CONNECT not supported by this listener", http.StatusInternalServerError)
+		return
+	}
+	client, _, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(resp, "Unable to hijack connection", http.StatusInternalServerError)
+		return
+	}
+	defer client.Close()
+
+	if _, err := client.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		return
+	}
+
+	release := p.limiter.acquireTunnel()
+	defer release()
+	p.shuttle(clientIP, identityFor(req), destHost, req, client, upstream)
+}
+
+// dialDest dials host (host:port) for a CONNECT or MITM'd request, using
+// p.DialDest if set (e.g. to chain through a SOCKS5 upstream via
+// SOCKS5Dialer) or a plain net.Dial otherwise.
+func (p *Proxy) dialDest(host string) (net.Conn, error) {
+	if p.DialDest != nil {
+		return p.DialDest(host)
+	}
+	return net.Dial("tcp", host)
+}
+
+// splitHostPort splits a CONNECT target of the form "host:port" into its
+// host, defaulting the port to 443 if absent (as is typical for CONNECT
+// requests, which almost always precede a TLS handshake).
+func splitHostPort(hostport string) (host string, port string, err error) {
+	host, port, err = net.SplitHostPort(hostport)
+	if err != nil {
+		if strings.Contains(err.Error(), "missing port") {
+			return hostport, "443", nil
+		}
+		return "", "", err
+	}
+	return host, port, nil
+}
+
+// shuttle copies bytes in both directions between client and upstream,
+// gating each chunk through p.limiter (see copyWithRateLimit) and reporting
+// the total for each direction to OnBytesReceived/OnBytesSent once that
+// direction's copy finishes. Each direction closes the *other* conn as soon
+// as it ends, so e.g. upstream closing first (an origin that doesn't do
+// keepalive is common) unblocks the client-facing Read instead of leaving
+// it hanging forever; callers can still close both again themselves. It
+// blocks until both directions have finished.
+func (p *Proxy) shuttle(clientIP string, identity string, destHost string, req *http.Request, client net.Conn, upstream net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		defer upstream.Close()
+		written, err := p.copyWithRateLimit(upstream, client, clientIP, destHost)
+		if p.OnBytesReceived != nil && written > 0 {
+			p.OnBytesReceived(clientIP, identity, destHost, req, written)
+		}
+		if err != nil {
+			log.Printf("Error shuttling CONNECT traffic: %s", err)
+		}
+		done <- struct{}{}
+	}()
+	go func() {
+		defer client.Close()
+		written, err := p.copyWithRateLimit(client, upstream, clientIP, destHost)
+		if p.OnBytesSent != nil && written > 0 {
+			p.OnBytesSent(clientIP, identity, destHost, req, written)
+		}
+		if err != nil {
+			log.Printf("Error shuttling CONNECT traffic: %s", err)
+		}
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
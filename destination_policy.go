@@ -0,0 +1,18 @@
+package enproxy
+
+import "fmt"
+
+// checkDestinationAllowed applies Proxy.BlacklistHost and
+// Proxy.AllowDestination (in that order) before the outbound dial in the
+// request-processing path, returning a non-nil error - which callers
+// should surface to the encapsulated client as 403 - if either hook
+// rejects host for clientIP.
+func (p *Proxy) checkDestinationAllowed(clientIP string, host string) error {
+	if p.BlacklistHost != nil && p.BlacklistHost(host) {
+		return fmt.Errorf("Destination %s is blacklisted", host)
+	}
+	if p.AllowDestination != nil && !p.AllowDestination(clientIP, host) {
+		return fmt.Errorf("Destination %s is not allowed for client %s", host, clientIP)
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package enproxy
+
+import (
+	"testing"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestCheckDestinationAllowedNoPolicy(t *testing.T) {
+	p := &Proxy{}
+	assert.NoError(t, p.checkDestinationAllowed("1.2.3.4", "example.com"), "No hooks configured should allow everything")
+}
+
+func TestCheckDestinationAllowedBlacklisted(t *testing.T) {
+	p := &Proxy{
+		BlacklistHost: func(host string) bool { return host == "blocked.example.com" },
+	}
+	assert.Error(t, p.checkDestinationAllowed("1.2.3.4", "blocked.example.com"), "Blacklisted host should be rejected")
+	assert.NoError(t, p.checkDestinationAllowed("1.2.3.4", "ok.example.com"), "Non-blacklisted host should be allowed")
+}
+
+func TestCheckDestinationAllowedPerClient(t *testing.T) {
+	p := &Proxy{
+		AllowDestination: func(clientIP string, host string) bool { return clientIP == "1.2.3.4" },
+	}
+	assert.NoError(t, p.checkDestinationAllowed("1.2.3.4", "example.com"), "Allowed client should pass")
+	assert.Error(t, p.checkDestinationAllowed("9.9.9.9", "example.com"), "Disallowed client should be rejected")
+}
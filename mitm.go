@@ -0,0 +1,136 @@
+package enproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/getlantern/keyman"
+)
+
+// mitmLeafLifetime is how long a dynamically minted leaf certificate is
+// valid for. Short-lived certs mean we don't need to worry about revoking
+// them.
+const mitmLeafLifetime = 24 * time.Hour
+
+// mitmConnect services a CONNECT request in MITM mode: it TLS-terminates
+// toward the client using a leaf certificate minted on the fly and signed
+// by p.MITMCAKey/p.MITMCACert, then dials the origin through p.dialDest
+// (the same DialDest-aware dial used by the plain-CONNECT path) and
+// TLS-handshakes over that connection, so that p.OnRequest/p.OnResponse (if
+// set) can inspect and modify plaintext request/response traffic before
+// it's relayed.
+func (p *Proxy) mitmConnect(resp http.ResponseWriter, req *http.Request, clientIP string) {
+	if p.MITMCAKey == nil || p.MITMCACert == nil {
+		http.Error(resp, "MITM not configured", http.StatusInternalServerError)
+		return
+	}
+
+	host, _, err := splitHostPort(req.Host)
+	if err != nil {
+		http.Error(resp, "Invalid CONNECT host: "+req.Host, http.StatusBadRequest)
+		return
+	}
+
+	if err := p.checkDestinationAllowed(clientIP, host); err != nil {
+		http.Error(resp, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	leafCert, err := p.mintLeafCert(host)
+	if err != nil {
+		http.Error(resp, "Unable to mint MITM certificate", http.StatusInternalServerError)
+		return
+	}
+
+	hijacker, ok := resp.(http.Hijacker)
+	if !ok {
+		http.Error(resp, "CONNECT not supported by this listener", http.StatusInternalServerError)
+		return
+	}
+	client, _, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(resp, "Unable to hijack connection", http.StatusInternalServerError)
+		return
+	}
+	defer client.Close()
+
+	if _, err := client.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		return
+	}
+
+	clientTLS := tls.Server(client, &tls.Config{Certificates: []tls.Certificate{*leafCert}})
+	if err := clientTLS.Handshake(); err != nil {
+		return
+	}
+	defer clientTLS.Close()
+
+	originConn, err := p.dialDest(req.Host)
+	if err != nil {
+		return
+	}
+	originTLS := tls.Client(originConn, &tls.Config{ServerName: host})
+	if err := originTLS.Handshake(); err != nil {
+		originConn.Close()
+		return
+	}
+	defer originTLS.Close()
+
+	release := p.limiter.acquireTunnel()
+	defer release()
+
+	handler := p.OnRequest
+	if handler == nil {
+		p.shuttle(clientIP, identityFor(req), host, req, clientTLS, originTLS)
+		return
+	}
+
+	serveIntercepted(clientTLS, originTLS, p, clientIP, identityFor(req), host)
+}
+
+// mintLeafCert generates a fresh key pair and leaf certificate for host,
+// signed by the proxy's configured MITM CA. It can't use leafKey's own
+// TLSCertificateFor - that convenience wrapper always signs with the
+// receiver's own private key, whereas a leaf cert needs to be signed by
+// p.MITMCAKey (the CA's key) while still carrying leafKey's public key, so
+// it builds the x509.Certificate template by hand and signs it via
+// CertificateForKey instead.
+func (p *Proxy) mintLeafCert(host string) (*tls.Certificate, error) {
+	leafKey, err := keyman.GeneratePK(2048)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to generate leaf key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject: pkix.Name{
+			Organization: []string{"enproxy-mitm"},
+			CommonName:   host,
+		},
+		NotBefore:             time.Now().Add(-1 * time.Hour),
+		NotAfter:              time.Now().Add(mitmLeafLifetime),
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+
+	leafCert, err := p.MITMCAKey.CertificateForKey(template, p.MITMCACert, &leafKey.RSA().PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to sign leaf certificate for %s: %s", host, err)
+	}
+	keypair, err := tls.X509KeyPair(leafCert.PEMEncoded(), leafKey.PEMEncoded())
+	if err != nil {
+		return nil, fmt.Errorf("Unable to build keypair for %s: %s", host, err)
+	}
+	return &keypair, nil
+}
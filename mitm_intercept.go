@@ -0,0 +1,78 @@
+package enproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"log"
+	"net/http"
+)
+
+// countingWriter wraps an io.Writer, tallying the bytes written through it
+// so serveIntercepted can report each forwarded request/response's size to
+// OnBytesReceived/OnBytesSent after the fact.
+type countingWriter struct {
+	io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// serveIntercepted reads successive request/response pairs off a MITM'd TLS
+// connection, giving p.OnRequest and p.OnResponse a chance to inspect (and
+// replace) each before it's forwarded, until the client or origin closes the
+// connection. This is the plaintext-visible counterpart to shuttle(), used
+// only once both legs have been TLS-terminated by mitmConnect. Reads off
+// both legs are gated through p.limiter (see rateLimitedReader), same as
+// shuttle's raw-byte copying; identity is whatever Auth.Validate returned
+// for the CONNECT request that established this tunnel.
+func serveIntercepted(client *tls.Conn, origin *tls.Conn, p *Proxy, clientIP string, identity string, destHost string) {
+	clientReader := bufio.NewReader(&rateLimitedReader{Reader: client, limiter: p.limiter, clientIP: clientIP, destHost: destHost})
+	originReader := bufio.NewReader(&rateLimitedReader{Reader: origin, limiter: p.limiter, clientIP: clientIP, destHost: destHost})
+
+	for {
+		req, err := http.ReadRequest(clientReader)
+		if err != nil {
+			return
+		}
+
+		if p.OnRequest != nil {
+			req = p.OnRequest(req)
+		}
+		originWriter := &countingWriter{Writer: origin}
+		if err := req.Write(originWriter); err != nil {
+			log.Printf("Error forwarding intercepted request: %s", err)
+			return
+		}
+		if p.OnBytesReceived != nil && originWriter.n > 0 {
+			p.OnBytesReceived(clientIP, identity, destHost, req, originWriter.n)
+		}
+
+		resp, err := http.ReadResponse(originReader, req)
+		if err != nil {
+			return
+		}
+
+		if p.OnResponse != nil {
+			resp = p.OnResponse(req, resp)
+		}
+		clientWriter := &countingWriter{Writer: client}
+		if err := resp.Write(clientWriter); err != nil {
+			log.Printf("Error forwarding intercepted response: %s", err)
+			return
+		}
+		if p.OnBytesSent != nil && clientWriter.n > 0 {
+			p.OnBytesSent(clientIP, identity, destHost, req, clientWriter.n)
+		}
+		if err := resp.Body.Close(); err != nil {
+			return
+		}
+		if req.Close || resp.Close {
+			return
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package enproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/getlantern/keyman"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+const xEnproxyIdentityHeader = "X-Enproxy-Identity"
+
+// destConnTimeout bounds how long serveEncapsulated waits for a response
+// chunk from the destination before returning an empty body, so that a
+// quiet destination doesn't hang the client's next poll indefinitely.
+const destConnTimeout = 200 * time.Millisecond
+
+type ctxKey int
+
+const destConnCtxKey ctxKey = iota
+
+// destConnHolder pins per-client-TCP-connection state (via
+// Server.ConnContext): the destination connection, so successive
+// encapsulated requests over the same keep-alive connection reuse it
+// instead of re-dialing per request, and the Auth.Validate result together
+// with the Proxy-Authorization value it was computed for, so it runs once
+// per connection and credential rather than once per chunk (see
+// Proxy.authenticatedIdentity).
+type destConnHolder struct {
+	mutex sync.Mutex
+	conn  net.Conn
+
+	authDone   bool
+	authHeader string
+	identity   string
+	authErr    error
+}
+
+// Proxy is an enproxy server: it accepts either enproxy-encapsulated
+// requests (a sequence of POSTs whose Host is the real destination) or
+// plain HTTP CONNECT requests on the same listener, and relays them to
+// their destination.
+type Proxy struct {
+	// OnBytesReceived is called with bytes received from the client (and
+	// forwarded on to destAddr); OnBytesSent is called with bytes sent back
+	// to the client (received from destAddr). identity is whatever
+	// Auth.Validate returned for this request, or "" if Auth is unset.
+	OnBytesReceived func(clientIp string, identity string, destAddr string, req *http.Request, bytes int64)
+	OnBytesSent     func(clientIp string, identity string, destAddr string, req *http.Request, bytes int64)
+
+	// Auth, if set, requires every request to carry valid
+	// Proxy-Authorization credentials, challenging with 407 otherwise.
+	Auth Auth
+
+	// DialDest dials addr for both encapsulated requests and CONNECT
+	// tunnels, defaulting to net.Dial. Set it to route outbound
+	// connections through an upstream, e.g. via SOCKS5Dialer.
+	DialDest func(addr string) (net.Conn, error)
+
+	// HandleConnect and AlwaysMitm decide which CONNECT requests are
+	// intercepted (MITM'd) rather than tunneled verbatim (see connect.go,
+	// mitm.go).
+	HandleConnect func(req *http.Request) bool
+	AlwaysMitm    bool
+
+	// MITMCAKey/MITMCACert are the CA used to sign on-the-fly leaf
+	// certificates for MITM'd connections (see mitm.go's mintLeafCert).
+	MITMCAKey  *keyman.PrivateKey
+	MITMCACert *keyman.Certificate
+
+	// OnRequest/OnResponse, only invoked for MITM'd connections, let
+	// callers inspect or rewrite the now-plaintext request/response (see
+	// mitm_intercept.go).
+	OnRequest  func(req *http.Request) *http.Request
+	OnResponse func(req *http.Request, resp *http.Response) *http.Response
+
+	// EnableHTTP2 lets clients using HTTP2Transport open a multiplexed
+	// stream instead of POSTing one chunk per request (see
+	// transport_http2_server.go's dispatchHTTP2).
+	EnableHTTP2 bool
+
+	// RateLimit throttles encapsulated and CONNECT/MITM traffic. The
+	// zero value is unlimited (see ratelimit.go).
+	RateLimit RateLimitPolicy
+
+	// BlacklistHost and AllowDestination are evaluated, in that order,
+	// before the outbound dial for every request; either one rejecting
+	// a destination results in a 403 to the client (see
+	// destination_policy.go's checkDestinationAllowed).
+	BlacklistHost    func(host string) bool
+	AllowDestination func(clientIP string, host string) bool
+
+	limiterOnce sync.Once
+	limiter     *rateLimiter
+}
+
+// Serve accepts connections on l, handling both enproxy-encapsulated
+// requests and plain CONNECT requests.
+func (p *Proxy) Serve(l net.Listener) error {
+	p.ensureLimiter()
+
+	var handler http.Handler = http.HandlerFunc(p.handle)
+	if p.EnableHTTP2 {
+		// l is a plain TCP listener, so without h2c a HTTP2Transport client's
+		// raw HTTP/2 connection preface would just be read as garbled
+		// HTTP/1.1 by http.Server and rejected.
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+
+	// holders tracks the destConnHolder allocated for each in-flight client
+	// connection, so ConnState below can find and close its cached
+	// destination conn once the client connection itself goes away -
+	// ConnContext has no matching teardown hook of its own.
+	var holdersMutex sync.Mutex
+	holders := make(map[net.Conn]*destConnHolder)
+
+	server := &http.Server{
+		Handler: handler,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			holder := &destConnHolder{}
+			holdersMutex.Lock()
+			holders[c] = holder
+			holdersMutex.Unlock()
+			return context.WithValue(ctx, destConnCtxKey, holder)
+		},
+		ConnState: func(c net.Conn, state http.ConnState) {
+			if state != http.StateClosed && state != http.StateHijacked {
+				return
+			}
+			holdersMutex.Lock()
+			holder := holders[c]
+			delete(holders, c)
+			holdersMutex.Unlock()
+			if holder == nil {
+				return
+			}
+			holder.mutex.Lock()
+			destConn := holder.conn
+			holder.mutex.Unlock()
+			if destConn != nil {
+				destConn.Close()
+			}
+		},
+	}
+	return server.Serve(l)
+}
+
+// handle is the single entry point for every request Proxy.Serve accepts,
+// dispatching to CONNECT/MITM handling, the HTTP/2 multiplexed transport or
+// the original encapsulated-POST path.
+func (p *Proxy) handle(resp http.ResponseWriter, req *http.Request) {
+	clientIP := clientIPFor(req)
+
+	if p.Auth != nil {
+		identity, err := p.authenticatedIdentity(req)
+		if err != nil {
+			p.Auth.Challenge(resp)
+			return
+		}
+		req.Header.Set(xEnproxyIdentityHeader, identity)
+	} else {
+		// A client could otherwise set this itself and have an arbitrary
+		// spoofed identity delivered to OnBytesReceived/OnBytesSent.
+		req.Header.Del(xEnproxyIdentityHeader)
+	}
+
+	if req.Method == http.MethodConnect {
+		p.handleConnect(resp, req, clientIP)
+		return
+	}
+
+	if p.dispatchHTTP2(resp, req, clientIP) {
+		return
+	}
+
+	p.serveEncapsulated(resp, req, clientIP)
+}
+
+// clientIPFor extracts the client's IP (dropping the port) from
+// req.RemoteAddr, for use as the clientIp passed to OnBytesReceived/
+// OnBytesSent and to Proxy.AllowDestination/the rate limiter's per-client
+// scope.
+func clientIPFor(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// authenticatedIdentity validates req's Proxy-Authorization credentials via
+// p.Auth, caching the result on req's destConnHolder (see Serve's
+// ConnContext) so that Auth.Validate - which can be expensive, e.g.
+// HtpasswdAuth's bcrypt compare or ExternalAuth's subprocess - runs once
+// per underlying TCP connection rather than once per encapsulated chunk.
+// The cached result is reused only while req carries the same
+// Proxy-Authorization value it was computed for; any other value
+// (including none) is validated afresh.
+// If req carries no destConnHolder (shouldn't happen via Serve, but keeps
+// this safe to call directly), it falls back to validating every call.
+func (p *Proxy) authenticatedIdentity(req *http.Request) (string, error) {
+	holder, _ := req.Context().Value(destConnCtxKey).(*destConnHolder)
+	if holder == nil {
+		return p.Auth.Validate(req)
+	}
+
+	header := req.Header.Get("Proxy-Authorization")
+	holder.mutex.Lock()
+	defer holder.mutex.Unlock()
+	if holder.authDone && holder.authHeader == header {
+		return holder.identity, holder.authErr
+	}
+	holder.identity, holder.authErr = p.Auth.Validate(req)
+	holder.authHeader = header
+	holder.authDone = true
+	return holder.identity, holder.authErr
+}
+
+// identityFor returns the identity Auth.Validate stashed on req via
+// xEnproxyIdentityHeader, or "" if Auth is unset, for use as the identity
+// passed to OnBytesReceived/OnBytesSent.
+func identityFor(req *http.Request) string {
+	return req.Header.Get(xEnproxyIdentityHeader)
+}
+
+// hostOnly strips any port from a host:port address for use with
+// BlacklistHost/AllowDestination, which operate on hostnames.
+func hostOnly(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport
+	}
+	return host
+}
+
+// serveEncapsulated handles one request of the original POST-per-chunk
+// protocol: it dials (or reuses, via destConnHolder) a connection to
+// req.Host, writes the request body to it, and responds with whatever the
+// destination has sent back since the last request.
+func (p *Proxy) serveEncapsulated(resp http.ResponseWriter, req *http.Request, clientIP string) {
+	destAddr := req.Host
+	destHost := hostOnly(destAddr)
+
+	if err := p.checkDestinationAllowed(clientIP, destHost); err != nil {
+		http.Error(resp, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	holder, _ := req.Context().Value(destConnCtxKey).(*destConnHolder)
+	if holder == nil {
+		holder = &destConnHolder{}
+	}
+
+	holder.mutex.Lock()
+	destConn := holder.conn
+	if destConn == nil {
+		var err error
+		destConn, err = p.dialDest(destAddr)
+		if err != nil {
+			holder.mutex.Unlock()
+			http.Error(resp, "Unable to reach "+destAddr, http.StatusBadGateway)
+			return
+		}
+		holder.conn = destConn
+	}
+	holder.mutex.Unlock()
+
+	release := p.limiter.acquireTunnel()
+	defer release()
+
+	written, err := p.copyWithRateLimit(destConn, req.Body, clientIP, destHost)
+	if p.OnBytesReceived != nil && written > 0 {
+		p.OnBytesReceived(clientIP, identityFor(req), destAddr, req, written)
+	}
+	if err != nil {
+		http.Error(resp, "Error writing to destination", http.StatusBadGateway)
+		return
+	}
+
+	resp.Header().Set(X_ENPROXY_PROXY_HOST, destAddr)
+
+	destConn.SetReadDeadline(time.Now().Add(destConnTimeout))
+	buf := make([]byte, 32*1024)
+	n, _ := destConn.Read(buf)
+	destConn.SetReadDeadline(time.Time{})
+
+	resp.WriteHeader(http.StatusOK)
+	if n > 0 {
+		if err := p.limiter.WaitN(req.Context(), clientIP, destHost, n); err == nil {
+			resp.Write(buf[:n])
+			if p.OnBytesSent != nil {
+				p.OnBytesSent(clientIP, identityFor(req), destAddr, req, int64(n))
+			}
+		}
+	}
+}
+
+// copyWithRateLimit copies from src to dst in bounded chunks, gating each
+// chunk on the rate limiter before writing it.
+func (p *Proxy) copyWithRateLimit(dst io.Writer, src io.Reader, clientIP string, destAddr string) (int64, error) {
+	buf := make([]byte, 32*1024)
+	var total int64
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if werr := p.limiter.WaitN(context.Background(), clientIP, destAddr, n); werr != nil {
+				return total, werr
+			}
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return total, werr
+			}
+			total += int64(n)
+		}
+		if err != nil {
+			if err == io.EOF {
+				return total, nil
+			}
+			return total, err
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package enproxy
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/jackwakefield/gopac"
+)
+
+// ProxyFromPACURL fetches the PAC (Proxy Auto-Config) file at pacURL and
+// returns a DialProxy function that evaluates FindProxy (via gopac's
+// embedded JS interpreter) for each destination address to decide where to
+// connect, falling back to a direct connection when the PAC script returns
+// DIRECT.
+func ProxyFromPACURL(pacURL string) (func(destAddr string) (net.Conn, error), error) {
+	parser := new(gopac.Parser)
+	if err := parser.ParseUrl(pacURL); err != nil {
+		return nil, fmt.Errorf("Unable to parse PAC file at %s: %s", pacURL, err)
+	}
+
+	return DialProxyFromResolver("tcp", func(destAddr string) (*url.URL, error) {
+		host, _, err := net.SplitHostPort(destAddr)
+		if err != nil {
+			host = destAddr
+		}
+		result, err := parser.FindProxy("https://"+host+"/", host)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to evaluate PAC for %s: %s", destAddr, err)
+		}
+		return firstPACProxy(result)
+	}), nil
+}
+
+// firstPACProxy parses a FindProxyForURL result like
+// "PROXY proxy1:8080; PROXY proxy2:8080; DIRECT" and returns the first
+// usable entry, or nil if the script said DIRECT (or returned nothing we
+// understand).
+func firstPACProxy(result string) (*url.URL, error) {
+	for _, entry := range strings.Split(result, ";") {
+		fields := strings.Fields(strings.TrimSpace(entry))
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "DIRECT":
+			return nil, nil
+		case "PROXY", "HTTP":
+			if len(fields) != 2 {
+				continue
+			}
+			return &url.URL{Scheme: "http", Host: fields[1]}, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,46 @@
+package enproxy
+
+import (
+	"testing"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestFirstPACProxyDirect(t *testing.T) {
+	proxyURL, err := firstPACProxy("DIRECT")
+	if assert.NoError(t, err) {
+		assert.Nil(t, proxyURL, "DIRECT should mean dial the destination directly")
+	}
+}
+
+func TestFirstPACProxySingleProxy(t *testing.T) {
+	proxyURL, err := firstPACProxy("PROXY proxy.example.com:8080")
+	if assert.NoError(t, err) {
+		if assert.NotNil(t, proxyURL) {
+			assert.Equal(t, "proxy.example.com:8080", proxyURL.Host)
+		}
+	}
+}
+
+func TestFirstPACProxyPicksFirstOfMultiple(t *testing.T) {
+	proxyURL, err := firstPACProxy("PROXY primary.example.com:8080; PROXY backup.example.com:8080; DIRECT")
+	if assert.NoError(t, err) {
+		if assert.NotNil(t, proxyURL) {
+			assert.Equal(t, "primary.example.com:8080", proxyURL.Host)
+		}
+	}
+}
+
+func TestFirstPACProxyDirectFirstOfMultiple(t *testing.T) {
+	proxyURL, err := firstPACProxy("DIRECT; PROXY backup.example.com:8080")
+	if assert.NoError(t, err) {
+		assert.Nil(t, proxyURL, "A leading DIRECT should be honored even when it isn't the only entry")
+	}
+}
+
+func TestFirstPACProxyUnrecognized(t *testing.T) {
+	proxyURL, err := firstPACProxy("SOCKS proxy.example.com:1080")
+	if assert.NoError(t, err) {
+		assert.Nil(t, proxyURL, "An entry type we don't understand should be skipped, not acted on")
+	}
+}
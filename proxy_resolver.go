@@ -0,0 +1,62 @@
+package enproxy
+
+import (
+	"net"
+	"net/url"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// ProxyResolver picks the upstream to use for a given destination address.
+// It mirrors Config.ProxyResolver, which callers can set directly to plug
+// in their own per-destination logic (see ProxyFromEnvironment and
+// ProxyFromPACURL for two common implementations of this shape).
+//
+// A nil *url.URL with a nil error means "dial destAddr directly".
+type ProxyResolver func(destAddr string) (*url.URL, error)
+
+// ProxyFromEnvironment returns a DialProxy function that honors
+// HTTP_PROXY/HTTPS_PROXY/NO_PROXY (and their lowercase forms), resolving a
+// fresh decision for every destination address so that NO_PROXY is applied
+// per-conn rather than once for the whole process.
+func ProxyFromEnvironment(network string) func(destAddr string) (net.Conn, error) {
+	return DialProxyFromResolver(network, resolveFromEnvironment)
+}
+
+// resolveFromEnvironment is a ProxyResolver backed by
+// golang.org/x/net/http/httpproxy's standard HTTP_PROXY/HTTPS_PROXY/NO_PROXY
+// handling. httpproxy.Config.ProxyFunc branches on the request URL's scheme
+// ("https" consults HTTPSProxy, anything else HTTPProxy), so destAddr's
+// scheme has to be inferred from its port for both env vars to actually be
+// consulted rather than just HTTPS_PROXY.
+func resolveFromEnvironment(destAddr string) (*url.URL, error) {
+	cfg := httpproxy.FromEnvironment()
+	reqURL := &url.URL{Scheme: schemeFor(destAddr), Host: destAddr}
+	return cfg.ProxyFunc()(reqURL)
+}
+
+// schemeFor guesses "https" or "http" for destAddr based on its port, since
+// that's all httpproxy.Config.ProxyFunc uses a scheme for.
+func schemeFor(destAddr string) string {
+	_, port, err := net.SplitHostPort(destAddr)
+	if err == nil && port == "443" {
+		return "https"
+	}
+	return "http"
+}
+
+// DialProxyFromResolver adapts a ProxyResolver into a DialProxy function:
+// for each destination address, it asks resolve where to connect, dialing
+// destAddr directly if resolve returns a nil URL.
+func DialProxyFromResolver(network string, resolve ProxyResolver) func(destAddr string) (net.Conn, error) {
+	return func(destAddr string) (net.Conn, error) {
+		proxyURL, err := resolve(destAddr)
+		if err != nil {
+			return nil, err
+		}
+		if proxyURL == nil {
+			return net.Dial(network, destAddr)
+		}
+		return net.Dial(network, proxyURL.Host)
+	}
+}
@@ -0,0 +1,60 @@
+package enproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/getlantern/testify/assert"
+)
+
+// TestServeEncapsulatedPassesIdentityToCallbacks drives a single
+// encapsulated request through Proxy.handle with Auth configured, proving
+// OnBytesReceived/OnBytesSent receive the identity Auth.Validate
+// authenticated rather than requiring callers to dig it out of
+// X-Enproxy-Identity on req.Header themselves.
+func TestServeEncapsulatedPassesIdentityToCallbacks(t *testing.T) {
+	destAddr := startEchoServer(t)
+
+	var mutex sync.Mutex
+	var receivedIdentity, sentIdentity string
+
+	proxy := &Proxy{
+		Auth: NewBasicAuth(map[string]string{"alice": "secret"}),
+		OnBytesReceived: func(clientIp string, identity string, destAddr string, req *http.Request, bytes int64) {
+			mutex.Lock()
+			receivedIdentity = identity
+			mutex.Unlock()
+		},
+		OnBytesSent: func(clientIp string, identity string, destAddr string, req *http.Request, bytes int64) {
+			mutex.Lock()
+			sentIdentity = identity
+			mutex.Unlock()
+		},
+	}
+	proxy.ensureLimiter()
+
+	server := httptest.NewServer(http.HandlerFunc(proxy.handle))
+	defer server.Close()
+
+	req, err := http.NewRequest("POST", server.URL, strings.NewReader(TEXT))
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	req.Host = destAddr
+	req.Header.Set(xEnproxyOp, OP_WRITE)
+	setProxyAuthHeader(req, "alice", "secret")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Unable to issue encapsulated request: %v", err)
+	}
+	resp.Body.Close()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(t, "alice", receivedIdentity, "OnBytesReceived should see the identity Auth.Validate authenticated")
+	assert.Equal(t, "alice", sentIdentity, "OnBytesSent should see the identity Auth.Validate authenticated")
+}
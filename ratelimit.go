@@ -0,0 +1,163 @@
+package enproxy
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimitPolicy configures the throttling applied by a Proxy's request/
+// response copy loops. Any field left at its zero value is unlimited. This
+// is deliberately a small, additive control plane built directly on top of
+// the byte counts Proxy already tracks via OnBytesReceived/OnBytesSent.
+type RateLimitPolicy struct {
+	// GlobalBytesPerSecond caps aggregate throughput across all tunnels.
+	GlobalBytesPerSecond int64
+
+	// PerClientBytesPerSecond caps throughput for a single client IP.
+	PerClientBytesPerSecond int64
+
+	// PerDestinationBytesPerSecond caps throughput to a single
+	// destination host.
+	PerDestinationBytesPerSecond int64
+
+	// MaxConcurrentTunnels caps how many tunnels (CONNECT or
+	// enproxy-encapsulated) may be open at once. Zero means unlimited.
+	MaxConcurrentTunnels int
+}
+
+// maxChunkBytes is the largest chunk any copy loop in this package ever
+// hands to WaitN in one call (see copyWithRateLimit and copyAndFlush, both
+// using 32KB buffers). Burst must be at least this large, independent of
+// the configured steady-state rate, or x/time/rate.Limiter.WaitN returns a
+// hard "exceeds limiter's burst" error instead of throttling.
+const maxChunkBytes = 32 * 1024
+
+// rateLimiter enforces a RateLimitPolicy using a token bucket per scope
+// (global, client IP, destination host), plus a semaphore bounding
+// concurrent tunnels. Proxy.Serve constructs one from Proxy.RateLimit, and
+// the request/response copy loops in serveEncapsulated/serveHTTP2Stream
+// call WaitN before forwarding each chunk of bytes. serveEncapsulated's
+// loops also report those bytes to OnBytesReceived/OnBytesSent;
+// serveHTTP2Stream's do not call either callback.
+type rateLimiter struct {
+	policy RateLimitPolicy
+
+	global *rate.Limiter
+
+	mutex         sync.Mutex
+	perClient     map[string]*rate.Limiter
+	perDest       map[string]*rate.Limiter
+	tunnelTickets chan struct{}
+}
+
+// ensureLimiter lazily builds p.limiter from p.RateLimit the first time
+// Proxy.Serve runs, so every dispatch path (serveEncapsulated,
+// handleConnect/mitmConnect, dispatchHTTP2) shares the same rateLimiter.
+func (p *Proxy) ensureLimiter() {
+	p.limiterOnce.Do(func() {
+		p.limiter = newRateLimiter(p.RateLimit)
+	})
+}
+
+// newRateLimiter builds a rateLimiter for policy. It's always safe to call
+// WaitN/acquireTunnel (and the release func it returns) on the result, even when policy is the
+// zero value (everything is simply unlimited).
+func newRateLimiter(policy RateLimitPolicy) *rateLimiter {
+	rl := &rateLimiter{
+		policy:    policy,
+		perClient: make(map[string]*rate.Limiter),
+		perDest:   make(map[string]*rate.Limiter),
+	}
+	if policy.GlobalBytesPerSecond > 0 {
+		rl.global = rate.NewLimiter(rate.Limit(policy.GlobalBytesPerSecond), burstFor(policy.GlobalBytesPerSecond))
+	}
+	if policy.MaxConcurrentTunnels > 0 {
+		rl.tunnelTickets = make(chan struct{}, policy.MaxConcurrentTunnels)
+	}
+	return rl
+}
+
+// WaitN blocks until n bytes are permitted to flow for clientIP/destHost
+// under all three scopes (global, per-client, per-destination). A nil
+// rateLimiter (Proxy.Serve never called) never blocks.
+func (rl *rateLimiter) WaitN(ctx context.Context, clientIP string, destHost string, n int) error {
+	if rl == nil {
+		return nil
+	}
+	if rl.global != nil {
+		if err := rl.global.WaitN(ctx, n); err != nil {
+			return err
+		}
+	}
+	if rl.policy.PerClientBytesPerSecond > 0 {
+		if err := rl.limiterFor(&rl.perClient, clientIP, rl.policy.PerClientBytesPerSecond).WaitN(ctx, n); err != nil {
+			return err
+		}
+	}
+	if rl.policy.PerDestinationBytesPerSecond > 0 {
+		if err := rl.limiterFor(&rl.perDest, destHost, rl.policy.PerDestinationBytesPerSecond).WaitN(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// limiterFor returns the token bucket for key within scope, creating it
+// (sized to bytesPerSecond) on first use.
+func (rl *rateLimiter) limiterFor(scope *map[string]*rate.Limiter, key string, bytesPerSecond int64) *rate.Limiter {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	limiter, found := (*scope)[key]
+	if !found {
+		limiter = rate.NewLimiter(rate.Limit(bytesPerSecond), burstFor(bytesPerSecond))
+		(*scope)[key] = limiter
+	}
+	return limiter
+}
+
+// burstFor sizes a limiter's burst large enough to admit the biggest chunk
+// the copy loops ever present (maxChunkBytes) even when bytesPerSecond is
+// configured well below that, so a modest rate throttles traffic instead of
+// permanently erroring out of WaitN.
+func burstFor(bytesPerSecond int64) int {
+	burst := int(bytesPerSecond)
+	if burst < maxChunkBytes {
+		burst = maxChunkBytes
+	}
+	return burst
+}
+
+// rateLimitedReader wraps an io.Reader, gating each Read through limiter's
+// WaitN before returning bytes. It lets read paths built on bufio.Reader
+// (serveIntercepted's request/response parsing) share the same throttling
+// as the raw-byte copy loops (copyWithRateLimit, copyAndFlush).
+type rateLimitedReader struct {
+	io.Reader
+	limiter  *rateLimiter
+	clientIP string
+	destHost string
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		if werr := r.limiter.WaitN(context.Background(), r.clientIP, r.destHost, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// acquireTunnel blocks until a concurrent-tunnel slot is free, returning a
+// func to release it when the tunnel closes. If MaxConcurrentTunnels is
+// unset, the release func is a no-op and acquisition never blocks.
+func (rl *rateLimiter) acquireTunnel() func() {
+	if rl == nil || rl.tunnelTickets == nil {
+		return func() {}
+	}
+	rl.tunnelTickets <- struct{}{}
+	return func() { <-rl.tunnelTickets }
+}
@@ -0,0 +1,51 @@
+package enproxy
+
+import (
+	"context"
+	"testing"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestRateLimiterUnlimitedByDefault(t *testing.T) {
+	rl := newRateLimiter(RateLimitPolicy{})
+	err := rl.WaitN(context.Background(), "1.2.3.4", "example.com:443", maxChunkBytes)
+	assert.NoError(t, err, "Zero-value policy should never block or error")
+}
+
+func TestRateLimiterNilIsUnlimited(t *testing.T) {
+	var rl *rateLimiter
+	err := rl.WaitN(context.Background(), "1.2.3.4", "example.com:443", maxChunkBytes)
+	assert.NoError(t, err, "A nil rateLimiter (Proxy.Serve never called) should never block or error")
+	rl.acquireTunnel()()
+}
+
+func TestRateLimiterAdmitsFullSizeChunkEvenAtLowRate(t *testing.T) {
+	// A deliberately low configured rate should still admit one
+	// maxChunkBytes write without erroring - burst must be sized to
+	// maxChunkBytes regardless of the configured steady-state rate.
+	rl := newRateLimiter(RateLimitPolicy{PerClientBytesPerSecond: 1024})
+	err := rl.WaitN(context.Background(), "1.2.3.4", "example.com:443", maxChunkBytes)
+	assert.NoError(t, err, "A single chunk up to maxChunkBytes should never exceed the limiter's burst")
+}
+
+func TestRateLimiterMaxConcurrentTunnels(t *testing.T) {
+	rl := newRateLimiter(RateLimitPolicy{MaxConcurrentTunnels: 1})
+
+	release := rl.acquireTunnel()
+
+	acquired := make(chan struct{})
+	go func() {
+		rl.acquireTunnel()
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("Second acquireTunnel should have blocked while the first tunnel was still held")
+	default:
+	}
+
+	release()
+	<-acquired
+}
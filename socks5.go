@@ -0,0 +1,48 @@
+package enproxy
+
+import (
+	"net"
+
+	"golang.org/x/net/proxy"
+)
+
+// SOCKS5Dialer builds a dial function that connects to network/addr (the
+// SOCKS5 server) and then asks it to relay the connection to whatever
+// destination address is passed to the returned func. auth may be nil if the
+// SOCKS5 server doesn't require authentication.
+//
+// The returned func is suitable for use as Proxy.DialDest on the server
+// side, where the address passed in really is the final destination to
+// reach through the SOCKS5 upstream. It is NOT suitable for Config.DialProxy
+// on the client side - use SOCKS5ProxyDialer there instead, since DialProxy
+// is called with the Conn's destination address but must return a
+// connection to the enproxy Proxy, not to that destination.
+func SOCKS5Dialer(network, addr string, auth *proxy.Auth) func(addr string) (net.Conn, error) {
+	return func(destAddr string) (net.Conn, error) {
+		dialer, err := proxy.SOCKS5(network, addr, auth, proxy.Direct)
+		if err != nil {
+			return nil, err
+		}
+		return dialer.Dial("tcp", destAddr)
+	}
+}
+
+// SOCKS5ProxyDialer builds a dial function suitable for use as
+// Config.DialProxy: it connects to the SOCKS5 server at socks5Addr and asks
+// it to relay the connection to proxyAddr, the enproxy Proxy this Conn
+// should actually talk to. auth may be nil if the SOCKS5 server doesn't
+// require authentication.
+//
+// Unlike SOCKS5Dialer, the destAddr the returned func is called with (the
+// Conn's ultimate destination, not the Proxy) plays no part in the SOCKS5
+// hop and is ignored - that destination instead travels as the Host of the
+// encapsulated request itself (see doRequest).
+func SOCKS5ProxyDialer(network, socks5Addr string, auth *proxy.Auth, proxyAddr string) func(destAddr string) (net.Conn, error) {
+	return func(destAddr string) (net.Conn, error) {
+		dialer, err := proxy.SOCKS5(network, socks5Addr, auth, proxy.Direct)
+		if err != nil {
+			return nil, err
+		}
+		return dialer.Dial("tcp", proxyAddr)
+	}
+}
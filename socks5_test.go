@@ -0,0 +1,19 @@
+package enproxy
+
+import (
+	"testing"
+
+	"github.com/getlantern/testify/assert"
+)
+
+func TestSOCKS5DialerPropagatesDialError(t *testing.T) {
+	dial := SOCKS5Dialer("tcp", "127.0.0.1:0", nil)
+	_, err := dial("example.com:80")
+	assert.Error(t, err, "Dialing a SOCKS5 server that isn't listening should surface an error")
+}
+
+func TestSOCKS5ProxyDialerPropagatesDialError(t *testing.T) {
+	dial := SOCKS5ProxyDialer("tcp", "127.0.0.1:0", nil, "proxy.example.com:8080")
+	_, err := dial("example.com:80")
+	assert.Error(t, err, "Dialing a SOCKS5 server that isn't listening should surface an error")
+}
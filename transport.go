@@ -0,0 +1,28 @@
+package enproxy
+
+import (
+	"io"
+	"net"
+)
+
+// Transport is an alternate way of carrying the encapsulated byte stream
+// between Conn and the proxy, in place of the default sequence of
+// non-pipelined POST requests performed by processRequests. Config.Transport
+// selects one; when unset, processRequests falls back to its original
+// POST-per-chunk behavior.
+//
+// A Transport opens a single duplex stream per Conn and is responsible for
+// its own connection reuse/pooling, since the whole point is to amortize a
+// long-lived connection (HTTP/2, WebSocket, ...) across many chunks instead
+// of redialing per request.
+type Transport interface {
+	// OpenStream dials (or reuses a pooled connection to) proxyAddr and
+	// returns a duplex stream for this logical Conn. dialProxy is the dial
+	// function Conn derives from Config.ProxyResolver or Config.DialProxy,
+	// used to establish the underlying transport connection when one isn't
+	// already pooled.
+	// user/pass are Config.ProxyUser/Config.ProxyPass, for the Transport to
+	// stamp on the stream-opening request the same way doRequest does for
+	// the POST-per-chunk path.
+	OpenStream(proxyAddr string, dialProxy func(addr string) (net.Conn, error), user string, pass string) (io.ReadWriteCloser, error)
+}
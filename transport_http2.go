@@ -0,0 +1,105 @@
+package enproxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"golang.org/x/net/http2"
+)
+
+// X_ENPROXY_TRANSPORT is set to "http2" on the single long-lived request
+// that opens an HTTP2Transport stream, so Proxy.Serve can recognize it and
+// hand it off to serveHTTP2Stream instead of the usual encapsulation
+// handling.
+const X_ENPROXY_TRANSPORT = "X-Enproxy-Transport"
+
+// HTTP2Transport is a Transport that multiplexes a Conn's reads and writes
+// over a single long-lived HTTP/2 connection to the proxy, rather than
+// issuing a new POST per chunk. It preserves in-order delivery for free
+// (within the one HTTP/2 stream) and lets the idle-timeout loop shrink to a
+// simple keepalive, since there's no per-chunk redial cost to amortize.
+//
+// The zero value is ready to use and pools connections within that one
+// HTTP2Transport value; construct one and share it across Dial calls that
+// talk to the same proxy to get the pooling benefit.
+type HTTP2Transport struct {
+	mutex sync.Mutex
+	conns map[string]*http2.ClientConn
+	t     http2.Transport
+}
+
+// OpenStream implements the Transport interface. It reuses a pooled
+// *http2.ClientConn for proxyAddr if one is healthy, dialing (and
+// HTTP/2-handshaking) a new one via dialProxy otherwise, then opens a new
+// stream on it by issuing a long-lived POST whose body and response body
+// together form a duplex byte stream.
+func (ht *HTTP2Transport) OpenStream(proxyAddr string, dialProxy func(addr string) (net.Conn, error), user string, pass string) (io.ReadWriteCloser, error) {
+	cc, err := ht.clientConnFor(proxyAddr, dialProxy)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest("POST", "https://"+proxyAddr+"/", pr)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(X_ENPROXY_TRANSPORT, "http2")
+	setProxyAuthHeader(req, user, pass)
+
+	resp, err := cc.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return &h2Stream{body: resp.Body, out: pw}, nil
+}
+
+// clientConnFor returns a pooled, still-usable *http2.ClientConn for
+// proxyAddr, establishing a new one if necessary.
+func (ht *HTTP2Transport) clientConnFor(proxyAddr string, dialProxy func(addr string) (net.Conn, error)) (*http2.ClientConn, error) {
+	ht.mutex.Lock()
+	defer ht.mutex.Unlock()
+
+	if ht.conns == nil {
+		ht.conns = make(map[string]*http2.ClientConn)
+	}
+	if cc, found := ht.conns[proxyAddr]; found && cc.CanTakeNewRequest() {
+		return cc, nil
+	}
+
+	conn, err := dialProxy(proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	cc, err := ht.t.NewClientConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ht.conns[proxyAddr] = cc
+	return cc, nil
+}
+
+// h2Stream adapts an HTTP/2 request/response pair (a pipe we write into as
+// the request body, and the response body we read from) to the
+// io.ReadWriteCloser shape that processRequests' multiplexed loop expects.
+type h2Stream struct {
+	body io.ReadCloser
+	out  *io.PipeWriter
+}
+
+func (s *h2Stream) Read(p []byte) (int, error) {
+	return s.body.Read(p)
+}
+
+func (s *h2Stream) Write(p []byte) (int, error) {
+	return s.out.Write(p)
+}
+
+func (s *h2Stream) Close() error {
+	s.out.Close()
+	return s.body.Close()
+}
@@ -0,0 +1,94 @@
+package enproxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+)
+
+// dispatchHTTP2 reports whether req is an HTTP2Transport stream request
+// this Proxy should serve, handling it (and returning true) if so. Proxy.handle
+// calls this for every non-CONNECT request, ahead of the original
+// encapsulated-POST path; it returns false straight away unless
+// p.EnableHTTP2 is set, keeping the HTTP/2 routing decision alongside the
+// rest of its implementation.
+func (p *Proxy) dispatchHTTP2(resp http.ResponseWriter, req *http.Request, clientIP string) bool {
+	if !p.EnableHTTP2 || req.Header.Get(X_ENPROXY_TRANSPORT) != "http2" {
+		return false
+	}
+	destAddr := req.Host
+	if err := p.checkDestinationAllowed(clientIP, hostOnly(destAddr)); err != nil {
+		http.Error(resp, err.Error(), http.StatusForbidden)
+		return true
+	}
+	p.serveHTTP2Stream(resp, req, clientIP, destAddr)
+	return true
+}
+
+// serveHTTP2Stream handles the server side of an HTTP2Transport stream:
+// dispatchHTTP2 calls here, instead of the usual encapsulation handling,
+// whenever it sees the X_ENPROXY_TRANSPORT header set to "http2" on an
+// incoming request. It dials destAddr once, then relays the request body
+// and the flushed response body as the two directions of a single duplex
+// connection for as long as the client keeps the stream open, gating both
+// directions through p.limiter the same way serveEncapsulated does. Either
+// direction ending (e.g. destAddr closing) closes the other side too, so
+// the stream doesn't hang forever waiting on a read that will never
+// produce more data.
+func (p *Proxy) serveHTTP2Stream(resp http.ResponseWriter, req *http.Request, clientIP string, destAddr string) {
+	flusher, ok := resp.(http.Flusher)
+	if !ok {
+		http.Error(resp, "HTTP/2 transport requires a flushable ResponseWriter", http.StatusInternalServerError)
+		return
+	}
+
+	upstream, err := p.dialDest(destAddr)
+	if err != nil {
+		http.Error(resp, "Unable to reach "+destAddr, http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+
+	release := p.limiter.acquireTunnel()
+	defer release()
+
+	resp.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	destHost := hostOnly(destAddr)
+	done := make(chan struct{}, 2)
+	go func() {
+		defer upstream.Close()
+		p.copyWithRateLimit(upstream, req.Body, clientIP, destHost)
+		done <- struct{}{}
+	}()
+	go func() {
+		defer req.Body.Close()
+		p.copyAndFlush(resp, flusher, upstream, clientIP, destHost)
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
+
+// copyAndFlush copies from src into dst, gating each chunk through
+// p.limiter (see copyWithRateLimit) and flushing after every chunk so that
+// the client sees bytes as they arrive rather than once dst's buffer fills.
+func (p *Proxy) copyAndFlush(dst io.Writer, flusher http.Flusher, src io.Reader, clientIP string, destHost string) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if werr := p.limiter.WaitN(context.Background(), clientIP, destHost, n); werr != nil {
+				return
+			}
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return
+			}
+			flusher.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}